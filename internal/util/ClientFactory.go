@@ -0,0 +1,256 @@
+/*
+ * Copyright (c) 2020 Devtron Labs
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"k8s.io/client-go/discovery"
+	diskcached "k8s.io/client-go/discovery/cached/disk"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// clientFactoryDefaultTTL is how long a cached entry is reused before the
+// factory rebuilds it, bounding staleness against cluster cert rotation or
+// CA changes without forcing a fresh TLS handshake on every call.
+const clientFactoryDefaultTTL = 10 * time.Minute
+
+var (
+	clientCacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "k8s_client_factory_requests_total",
+		Help: "Count of ClientFactory lookups by cache result (hit/miss).",
+	}, []string{"result"})
+
+	clientRequestLatencySeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "k8s_client_request_latency_seconds",
+		Help:    "Latency of requests issued through factory-built clients, by HTTP verb.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"verb"})
+)
+
+func init() {
+	prometheus.MustRegister(clientCacheRequestsTotal, clientRequestLatencySeconds)
+}
+
+// cachedClients holds everything built for one ClusterConfig: a shared
+// rest.Config/transport, cached discovery and the clients layered on top of
+// it, so none of them re-negotiate TLS per call.
+type cachedClients struct {
+	restConfig *rest.Config
+	transport  http.RoundTripper
+	// clientset is the one typed client every CoreV1 call in this package
+	// goes through (via clientset.CoreV1()) — it's the same client-go
+	// generation as dynamicClient, so a single rest.Config produces a
+	// consistent set of contextual clients instead of mixing API shapes.
+	clientset       kubernetes.Interface
+	dynamicClient   dynamic.Interface
+	discoveryClient discovery.CachedDiscoveryInterface
+	restMapper      *restmapper.DeferredDiscoveryRESTMapper
+	createdAt       time.Time
+}
+
+func (c *cachedClients) expired(ttl time.Duration) bool {
+	return time.Since(c.createdAt) > ttl
+}
+
+// ClientFactory builds, and memoizes by ClusterConfig, the rest.Config and
+// the typed/dynamic/discovery clients layered on top of it. Without it
+// every K8sUtil method call built a fresh rest.Config (and so a fresh TLS
+// handshake), which is wasteful for CD workloads that reconcile the same
+// clusters continuously.
+type ClientFactory struct {
+	logger *zap.SugaredLogger
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedClients
+}
+
+func NewClientFactory(logger *zap.SugaredLogger) *ClientFactory {
+	return &ClientFactory{
+		logger: logger,
+		ttl:    clientFactoryDefaultTTL,
+		cache:  make(map[string]*cachedClients),
+	}
+}
+
+// clusterConfigKey hashes the identifying fields of a ClusterConfig so
+// equivalent configs (same host, same credentials) share one cache entry.
+func clusterConfigKey(clusterConfig *ClusterConfig) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s|%s|%v|%v|%s|%s|%s|%s|%s|%s",
+		clusterConfig.Host,
+		clusterConfig.BearerToken,
+		clusterConfig.Insecure,
+		clusterConfig.TLSConfig.InsecureSkipTLSVerify,
+		clusterConfig.TLSConfig.ServerName,
+		clusterConfig.TLSConfig.CAData,
+		clusterConfig.TLSConfig.ClientCert,
+		clusterConfig.TLSConfig.ClientKey,
+		clusterConfig.Kubeconfig,
+		clusterConfig.Context,
+	)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached clients for clusterConfig, building and caching
+// them on miss or once the TTL has lapsed.
+func (f *ClientFactory) get(clusterConfig *ClusterConfig, build func() (*rest.Config, error)) (*cachedClients, error) {
+	key := clusterConfigKey(clusterConfig)
+
+	f.mu.Lock()
+	entry, ok := f.cache[key]
+	f.mu.Unlock()
+	if ok && !entry.expired(f.ttl) {
+		clientCacheRequestsTotal.WithLabelValues("hit").Inc()
+		return entry, nil
+	}
+	clientCacheRequestsTotal.WithLabelValues("miss").Inc()
+
+	restConfig, err := build()
+	if err != nil {
+		return nil, err
+	}
+	entry, err = f.buildEntry(restConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	f.cache[key] = entry
+	f.mu.Unlock()
+	return entry, nil
+}
+
+// buildEntry wires up every client off a single rest.Config copy so they
+// all share one underlying transport (client-go memoizes the TLS
+// transport per-config internally), instrumented with the latency metric.
+func (f *ClientFactory) buildEntry(restConfig *rest.Config) (*cachedClients, error) {
+	restConfig = rest.CopyConfig(restConfig)
+
+	// Build the raw transport before WrapTransport is set, so we keep a
+	// handle on client-go's own transport (the *http.Transport it caches
+	// by TLS config, possibly under client-go's auth wrappers, which Close
+	// unwraps; it is the same transport the wrapped clients below end up
+	// using) instead of the roundTripperFunc closure, which has no
+	// CloseIdleConnections to call from Close.
+	transport, err := rest.TransportFor(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	restConfig.WrapTransport = instrumentedRoundTripper
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	discoveryClient, err := newCachedDiscoveryClient(restConfig)
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewDeferredDiscoveryRESTMapper(discoveryClient)
+
+	return &cachedClients{
+		restConfig:      restConfig,
+		transport:       transport,
+		clientset:       clientset,
+		dynamicClient:   dynamicClient,
+		discoveryClient: discoveryClient,
+		restMapper:      mapper,
+		createdAt:       time.Now(),
+	}, nil
+}
+
+// instrumentedRoundTripper wraps the transport client-go builds for a
+// rest.Config with one that records per-verb request latency, mirroring
+// how client-go's own metrics hooks (tools/metrics) instrument requests.
+func instrumentedRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := rt.RoundTrip(req)
+		clientRequestLatencySeconds.WithLabelValues(req.Method).Observe(time.Since(start).Seconds())
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// newCachedDiscoveryClient backs discovery responses with a disk cache
+// under ~/.kube/cache, the same layout kubectl itself uses, so discovery
+// survives process restarts instead of re-querying the API server's
+// OpenAPI/group-version documents every time.
+func newCachedDiscoveryClient(restConfig *rest.Config) (discovery.CachedDiscoveryInterface, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = os.TempDir()
+	}
+	cacheDir := filepath.Join(home, ".kube", "cache", "discovery")
+	httpCacheDir := filepath.Join(home, ".kube", "cache", "http")
+	return diskcached.NewCachedDiscoveryClientForConfig(restConfig, cacheDir, httpCacheDir, clientFactoryDefaultTTL)
+}
+
+// Invalidate drops the cached entry for clusterConfig, forcing the next
+// call to rebuild it. Useful when a caller knows credentials/CA data
+// changed out from under a running cluster and doesn't want to wait out
+// the TTL.
+func (f *ClientFactory) Invalidate(clusterConfig *ClusterConfig) {
+	key := clusterConfigKey(clusterConfig)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.cache, key)
+}
+
+// Close idles out every cached transport and drops all cache entries. It
+// is meant to run once, at process shutdown.
+func (f *ClientFactory) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, entry := range f.cache {
+		rt := entry.transport
+		for rt != nil {
+			if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+				closer.CloseIdleConnections()
+				break
+			}
+			wrapper, ok := rt.(interface{ WrappedRoundTripper() http.RoundTripper })
+			if !ok {
+				break
+			}
+			rt = wrapper.WrappedRoundTripper()
+		}
+		delete(f.cache, key)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (c) 2020 Devtron Labs
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"context"
+	"encoding/json"
+
+	"go.uber.org/zap"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// devtronFieldManager is the field manager Devtron identifies itself as
+// when doing server-side apply, so other controllers reconciling the same
+// object (e.g. Argo CD itself) can tell Devtron's fields apart from theirs.
+const devtronFieldManager = "devtron"
+
+// DynamicResourceClient is a thin, GVK-agnostic wrapper around the dynamic
+// client scoped to one GroupVersionResource and namespace.
+type DynamicResourceClient struct {
+	logger    *zap.SugaredLogger
+	client    dynamic.NamespaceableResourceInterface
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+// GetDynamicClient returns a DynamicResourceClient scoped to gvr/namespace
+// against the cluster described by clusterConfig, reusing the dynamic
+// client cached by the K8sUtil's ClientFactory. Pass an empty namespace
+// for cluster-scoped resources.
+func (impl K8sUtil) GetDynamicClient(clusterConfig *ClusterConfig, gvr schema.GroupVersionResource, namespace string) (*DynamicResourceClient, error) {
+	entry, err := impl.clientFactory.get(clusterConfig, func() (*rest.Config, error) {
+		return impl.BuildRestConfig(clusterConfig)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &DynamicResourceClient{
+		logger:    impl.logger,
+		client:    entry.dynamicClient.Resource(gvr),
+		gvr:       gvr,
+		namespace: namespace,
+	}, nil
+}
+
+// GetMapperAndDynamicClient returns the cached RESTMapper and dynamic client
+// for clusterConfig, built (and reused across calls) by the same
+// ClientFactory GetDynamicClient uses. It exists for callers resolving
+// GVKs themselves against arbitrary manifests (the apply engine), so they
+// reuse the disk-backed discovery cache instead of paying a fresh discovery
+// round-trip on every call.
+func (impl K8sUtil) GetMapperAndDynamicClient(clusterConfig *ClusterConfig) (*restmapper.DeferredDiscoveryRESTMapper, dynamic.Interface, error) {
+	entry, err := impl.clientFactory.get(clusterConfig, func() (*rest.Config, error) {
+		return impl.BuildRestConfig(clusterConfig)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry.restMapper, entry.dynamicClient, nil
+}
+
+func (c *DynamicResourceClient) resourceInterface() dynamic.ResourceInterface {
+	if c.namespace == "" {
+		return c.client
+	}
+	return c.client.Namespace(c.namespace)
+}
+
+func (c *DynamicResourceClient) Get(ctx context.Context, name string) (*unstructured.Unstructured, error) {
+	return c.resourceInterface().Get(ctx, name, metav1.GetOptions{})
+}
+
+func (c *DynamicResourceClient) Create(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return c.resourceInterface().Create(ctx, obj, metav1.CreateOptions{})
+}
+
+func (c *DynamicResourceClient) Update(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	return c.resourceInterface().Update(ctx, obj, metav1.UpdateOptions{})
+}
+
+func (c *DynamicResourceClient) Patch(ctx context.Context, name string, pt types.PatchType, data []byte) (*unstructured.Unstructured, error) {
+	return c.resourceInterface().Patch(ctx, name, pt, data, metav1.PatchOptions{})
+}
+
+func (c *DynamicResourceClient) Delete(ctx context.Context, name string) error {
+	return c.resourceInterface().Delete(ctx, name, metav1.DeleteOptions{})
+}
+
+func (c *DynamicResourceClient) List(ctx context.Context, opts metav1.ListOptions) (*unstructured.UnstructuredList, error) {
+	return c.resourceInterface().List(ctx, opts)
+}
+
+func (c *DynamicResourceClient) Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+	return c.resourceInterface().Watch(ctx, opts)
+}
+
+// ApplyServerSide upserts obj via a server-side apply patch (PatchType:
+// ApplyPatchType) under the "devtron" field manager, so Devtron and any
+// other controller reconciling the same object (Argo CD's own controller,
+// for instance) only ever own the fields each of them actually sets.
+func (c *DynamicResourceClient) ApplyServerSide(ctx context.Context, obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	force := true
+	return c.resourceInterface().Patch(ctx, obj.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: devtronFieldManager,
+		Force:        &force,
+	})
+}
@@ -18,48 +18,154 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"go.uber.org/zap"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 
 	"k8s.io/apimachinery/pkg/types"
 	v12 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
+// All CoreV1 access below goes through v12.CoreV1Interface (the contextual,
+// generated-client shape backed by the cached clientset), not the old
+// *v12.CoreV1Client constructor — the dynamic/informer subsystems elsewhere
+// in this package only exist in the client-go generation that made every
+// generated client, typed and dynamic alike, take a ctx.
+
 type K8sUtil struct {
-	logger *zap.SugaredLogger
+	logger        *zap.SugaredLogger
+	clientFactory *ClientFactory
+	resourceCache *ResourceCache
+}
+
+// TLSConfig carries the transport security material used to talk to a
+// cluster's API server. It mirrors the fields rest.Config exposes for TLS
+// so callers aren't forced to fall back to Insecure.
+type TLSConfig struct {
+	CAData                []byte
+	ClientCert            []byte
+	ClientKey             []byte
+	ServerName            string
+	InsecureSkipTLSVerify bool
 }
 
+// ClusterConfig describes how to reach a cluster's API server through
+// Host/BearerToken/TLSConfig. Kubeconfig-based access goes through
+// GetClientFromKubeconfig / GetClientForContext instead, which take the
+// kubeconfig bytes directly and resolve everything, exec plugins included.
 type ClusterConfig struct {
 	Host        string
 	BearerToken string
+	TLSConfig   TLSConfig
+
+	// Insecure must be explicitly set by callers that want to skip TLS
+	// verification; it is never assumed.
+	Insecure bool
+
+	// Kubeconfig and Context are filled in by GetClientFromKubeconfig /
+	// GetClientForContext only to key the ClientFactory cache. GetClient,
+	// BuildRestConfig and the other methods taking a ClusterConfig do not
+	// read them.
+	Kubeconfig []byte
+	Context    string
 }
 
 func NewK8sUtil(logger *zap.SugaredLogger) *K8sUtil {
-	return &K8sUtil{logger: logger}
+	impl := &K8sUtil{logger: logger, clientFactory: NewClientFactory(logger)}
+	impl.resourceCache = NewResourceCache(logger, impl, nil, 0)
+	return impl
+}
+
+// GetClient returns the memoized CoreV1Client for clusterConfig, building
+// (and caching) the underlying rest.Config and transport on first use via
+// the K8sUtil's ClientFactory.
+func (impl K8sUtil) GetClient(clusterConfig *ClusterConfig) (v12.CoreV1Interface, error) {
+	entry, err := impl.clientFactory.get(clusterConfig, func() (*rest.Config, error) {
+		return impl.BuildRestConfig(clusterConfig)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.clientset.CoreV1(), nil
 }
 
-func (impl K8sUtil) GetClient(clusterConfig *ClusterConfig) (*v12.CoreV1Client, error) {
+// BuildRestConfig turns a ClusterConfig into a rest.Config, honoring CA
+// data, client certs and the Insecure opt-in. It does not look at
+// clusterConfig.Kubeconfig; use GetClientFromKubeconfig/GetClientForContext
+// for kubeconfig-based access. Exported so other subsystems (e.g. the
+// apply engine) that need a raw rest.Config for non-CoreV1 clients can
+// reuse the same resolution logic.
+func (impl K8sUtil) BuildRestConfig(clusterConfig *ClusterConfig) (*rest.Config, error) {
 	cfg := &rest.Config{}
 	cfg.Host = clusterConfig.Host
 	cfg.BearerToken = clusterConfig.BearerToken
-	cfg.Insecure = true
-	client, err := v12.NewForConfig(cfg)
-	return client, err
+	cfg.TLSClientConfig = rest.TLSClientConfig{
+		CAData:     clusterConfig.TLSConfig.CAData,
+		CertData:   clusterConfig.TLSConfig.ClientCert,
+		KeyData:    clusterConfig.TLSConfig.ClientKey,
+		ServerName: clusterConfig.TLSConfig.ServerName,
+		Insecure:   clusterConfig.TLSConfig.InsecureSkipTLSVerify || clusterConfig.Insecure,
+	}
+	return cfg, nil
+}
+
+// GetClientFromKubeconfig builds a CoreV1Client from a raw kubeconfig,
+// using its current-context (CA data, client certs, exec plugins and all),
+// the same way the external Helm/kube2msb integrations resolve clusters.
+func (impl K8sUtil) GetClientFromKubeconfig(kubeconfig []byte) (v12.CoreV1Interface, error) {
+	return impl.getClientForKubeconfig(kubeconfig, "")
+}
+
+// GetClientForContext is like GetClientFromKubeconfig but resolves a named
+// context instead of the kubeconfig's current-context, so one kubeconfig
+// holding several clusters can be reused across them.
+func (impl K8sUtil) GetClientForContext(kubeconfig []byte, contextName string) (v12.CoreV1Interface, error) {
+	return impl.getClientForKubeconfig(kubeconfig, contextName)
+}
+
+func (impl K8sUtil) getClientForKubeconfig(kubeconfig []byte, contextName string) (v12.CoreV1Interface, error) {
+	cacheKey := &ClusterConfig{Kubeconfig: kubeconfig, Context: contextName}
+	entry, err := impl.clientFactory.get(cacheKey, func() (*rest.Config, error) {
+		return impl.restConfigFromKubeconfig(kubeconfig, contextName)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry.clientset.CoreV1(), nil
 }
 
-func (impl K8sUtil) CreateNsIfNotExists(namespace string, clusterConfig *ClusterConfig) (err error) {
+func (impl K8sUtil) restConfigFromKubeconfig(kubeconfig []byte, contextName string) (*rest.Config, error) {
+	clientConfig, err := clientcmd.NewClientConfigFromBytes(kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig: %w", err)
+	}
+	if contextName != "" {
+		rawConfig, err := clientConfig.RawConfig()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := rawConfig.Contexts[contextName]; !ok {
+			return nil, fmt.Errorf("context %q not found in kubeconfig", contextName)
+		}
+		clientConfig = clientcmd.NewNonInteractiveClientConfig(rawConfig, contextName, &clientcmd.ConfigOverrides{}, nil)
+	}
+	return clientConfig.ClientConfig()
+}
+
+func (impl K8sUtil) CreateNsIfNotExists(ctx context.Context, namespace string, clusterConfig *ClusterConfig) (err error) {
 	client, err := impl.GetClient(clusterConfig)
 	if err != nil {
 		return err
 	}
-	exists, err := impl.checkIfNsExists(namespace, client)
+	exists, err := impl.checkIfNsExists(ctx, namespace, client)
 	if err != nil {
 		return err
 	}
@@ -67,13 +173,12 @@ func (impl K8sUtil) CreateNsIfNotExists(namespace string, clusterConfig *Cluster
 		return nil
 	}
 	impl.logger.Infow("ns not exists creating", "ns", namespace)
-	_, err = impl.createNs(namespace, client)
+	_, err = impl.createNs(ctx, namespace, client)
 	return err
 }
 
-func (impl K8sUtil) checkIfNsExists(namespace string, client *v12.CoreV1Client) (exists bool, err error) {
-	ns, err := client.Namespaces().Get(namespace, metav1.GetOptions{})
-	//ns, err := impl.k8sClient.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+func (impl K8sUtil) checkIfNsExists(ctx context.Context, namespace string, client v12.CoreV1Interface) (exists bool, err error) {
+	ns, err := client.Namespaces().Get(ctx, namespace, metav1.GetOptions{})
 	impl.logger.Debugw("ns fetch", "name", namespace, "res", ns)
 	if errors.IsNotFound(err) {
 		return false, nil
@@ -85,9 +190,9 @@ func (impl K8sUtil) checkIfNsExists(namespace string, client *v12.CoreV1Client)
 
 }
 
-func (impl K8sUtil) createNs(namespace string, client *v12.CoreV1Client) (ns *v1.Namespace, err error) {
+func (impl K8sUtil) createNs(ctx context.Context, namespace string, client v12.CoreV1Interface) (ns *v1.Namespace, err error) {
 	nsSpec := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
-	ns, err = client.Namespaces().Create(nsSpec)
+	ns, err = client.Namespaces().Create(ctx, nsSpec, metav1.CreateOptions{})
 	if err != nil {
 		return nil, err
 	} else {
@@ -95,70 +200,117 @@ func (impl K8sUtil) createNs(namespace string, client *v12.CoreV1Client) (ns *v1
 	}
 }
 
-func (impl K8sUtil) deleteNs(namespace string, client *v12.CoreV1Client) error {
-	err := client.Namespaces().Delete(namespace, &metav1.DeleteOptions{})
+func (impl K8sUtil) deleteNs(ctx context.Context, namespace string, client v12.CoreV1Interface) error {
+	err := client.Namespaces().Delete(ctx, namespace, metav1.DeleteOptions{})
 	return err
 }
 
-func (impl K8sUtil) getargoAppClient(clusterConfig *ClusterConfig) (*rest.RESTClient, error) {
-	config := &rest.Config{}
-	gv := schema.GroupVersion{Group: "argoproj.io", Version: "v1alpha1"}
-	config.GroupVersion = &gv
-	config.APIPath = "/apis"
-	config.Host = clusterConfig.Host
-	config.BearerToken = clusterConfig.BearerToken
-	config.Insecure = true
-	config.NegotiatedSerializer = serializer.NewCodecFactory(runtime.NewScheme())
-
-	client, err := rest.RESTClientFor(config)
-	return client, err
-}
+// argoApplicationGVR is the GVR for Argo CD's Application CRD. Resolving
+// the client through DynamicResourceClient (instead of hand-building a
+// rest.RESTClient with an empty scheme, as this used to) is what lets the
+// same pattern extend to Rollouts, SealedSecrets, Flagger and anything
+// else Devtron integrates with later.
+var argoApplicationGVR = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
 
-func (impl K8sUtil) CreateArgoApplication(namespace string, application string, clusterConfig *ClusterConfig) error {
-	client, err := impl.getargoAppClient(clusterConfig)
+func (impl K8sUtil) getArgoAppClient(namespace string, clusterConfig *ClusterConfig) (*DynamicResourceClient, error) {
+	return impl.GetDynamicClient(clusterConfig, argoApplicationGVR, namespace)
+}
 
+// CreateArgoApplication upserts an Argo CD Application via server-side
+// apply under the "devtron" field manager, so Argo CD's own controller
+// reconciling the same object doesn't get its fields clobbered.
+func (impl K8sUtil) CreateArgoApplication(ctx context.Context, namespace string, application string, clusterConfig *ClusterConfig) error {
+	client, err := impl.getArgoAppClient(namespace, clusterConfig)
+	if err != nil {
+		return err
+	}
+	obj, err := unstructuredFromJSON(application)
 	if err != nil {
 		return err
 	}
 	impl.logger.Infow("creating application", "req", application)
-	res, err := client.
-		Post().
-		Resource("applications").
-		Namespace(namespace).
-		Body([]byte(application)).
-		Do().Raw()
-	impl.logger.Infow("argo app create res", "res", string(res), "err", err)
+	res, err := client.ApplyServerSide(ctx, obj)
+	impl.logger.Infow("argo app create res", "res", res, "err", err)
 	return err
 }
 
-func (impl K8sUtil) GetConfigMap(namespace string, name string, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
-	client, err := impl.GetClient(clusterConfig)
+// UpdateArgoApplication applies changes to an existing Argo CD Application,
+// again via server-side apply so it composes with Argo CD's reconciler.
+func (impl K8sUtil) UpdateArgoApplication(ctx context.Context, namespace string, name string, application string, clusterConfig *ClusterConfig) (*unstructured.Unstructured, error) {
+	client, err := impl.getArgoAppClient(namespace, clusterConfig)
 	if err != nil {
 		return nil, err
 	}
-	cm, err := client.ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	obj, err := unstructuredFromJSON(application)
 	if err != nil {
 		return nil, err
-	} else {
-		return cm, nil
 	}
+	obj.SetName(name)
+	return client.ApplyServerSide(ctx, obj)
 }
 
-func (impl K8sUtil) GetConfigMapFast(namespace string, name string, client *v12.CoreV1Client) (*v1.ConfigMap, error) {
-	cm, err := client.ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+func (impl K8sUtil) GetArgoApplication(ctx context.Context, namespace string, name string, clusterConfig *ClusterConfig) (*unstructured.Unstructured, error) {
+	client, err := impl.getArgoAppClient(namespace, clusterConfig)
 	if err != nil {
 		return nil, err
-	} else {
-		return cm, nil
 	}
+	return client.Get(ctx, name)
+}
+
+// WatchArgoApplication streams status updates for a single Argo CD
+// Application back to the caller until ctx is cancelled. The returned
+// channel is closed once the underlying watch ends.
+func (impl K8sUtil) WatchArgoApplication(ctx context.Context, namespace string, name string, clusterConfig *ClusterConfig) (<-chan *unstructured.Unstructured, error) {
+	client, err := impl.getArgoAppClient(namespace, clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	w, err := client.Watch(ctx, metav1.ListOptions{FieldSelector: "metadata.name=" + name})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *unstructured.Unstructured)
+	go func() {
+		defer close(out)
+		defer w.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-w.ResultChan():
+				if !ok {
+					return
+				}
+				obj, ok := event.Object.(*unstructured.Unstructured)
+				if !ok {
+					continue
+				}
+				select {
+				case out <- obj:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func unstructuredFromJSON(application string) (*unstructured.Unstructured, error) {
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal([]byte(application), &obj.Object); err != nil {
+		return nil, fmt.Errorf("invalid argo application manifest: %w", err)
+	}
+	return obj, nil
 }
 
-func (impl K8sUtil) UpdateConfigMap(namespace string, cm *v1.ConfigMap, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
+func (impl K8sUtil) GetConfigMap(ctx context.Context, namespace string, name string, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
 	client, err := impl.GetClient(clusterConfig)
 	if err != nil {
 		return nil, err
 	}
-	cm, err = client.ConfigMaps(namespace).Update(cm)
+	cm, err := client.ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return nil, err
 	} else {
@@ -166,8 +318,18 @@ func (impl K8sUtil) UpdateConfigMap(namespace string, cm *v1.ConfigMap, clusterC
 	}
 }
 
-func (impl K8sUtil) UpdateConfigMapFast(namespace string, cm *v1.ConfigMap, client *v12.CoreV1Client) (*v1.ConfigMap, error) {
-	cm, err := client.ConfigMaps(namespace).Update(cm)
+// GetConfigMapFast reads from the cluster's informer-backed ConfigMap
+// cache, falling through to a live GET on a cache miss.
+func (impl K8sUtil) GetConfigMapFast(ctx context.Context, namespace string, name string, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
+	return impl.resourceCache.GetConfigMap(ctx, clusterConfig, namespace, name)
+}
+
+func (impl K8sUtil) UpdateConfigMap(ctx context.Context, namespace string, cm *v1.ConfigMap, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
+	client, err := impl.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	cm, err = client.ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
 	if err != nil {
 		return nil, err
 	} else {
@@ -175,7 +337,18 @@ func (impl K8sUtil) UpdateConfigMapFast(namespace string, cm *v1.ConfigMap, clie
 	}
 }
 
-func (impl K8sUtil) PatchConfigMap(namespace string, clusterConfig *ClusterConfig, name string, data map[string]interface{}) (*v1.ConfigMap, error) {
+// UpdateConfigMapFast re-fetches cm and retries on resource-version
+// conflicts instead of doing a blind Update against a possibly-stale copy.
+func (impl K8sUtil) UpdateConfigMapFast(ctx context.Context, namespace string, cm *v1.ConfigMap, clusterConfig *ClusterConfig) (*v1.ConfigMap, error) {
+	return impl.resourceCache.UpdateConfigMapWithRetry(ctx, clusterConfig, namespace, cm.Name, func(existing *v1.ConfigMap) {
+		existing.Data = cm.Data
+		existing.BinaryData = cm.BinaryData
+		existing.Labels = cm.Labels
+		existing.Annotations = cm.Annotations
+	})
+}
+
+func (impl K8sUtil) PatchConfigMap(ctx context.Context, namespace string, clusterConfig *ClusterConfig, name string, data map[string]interface{}) (*v1.ConfigMap, error) {
 	client, err := impl.GetClient(clusterConfig)
 	if err != nil {
 		return nil, err
@@ -184,16 +357,15 @@ func (impl K8sUtil) PatchConfigMap(namespace string, clusterConfig *ClusterConfi
 	if err != nil {
 		panic(err)
 	}
-	cm, err := client.ConfigMaps(namespace).Patch(name, types.PatchType(types.MergePatchType), b)
+	cm, err := client.ConfigMaps(namespace).Patch(ctx, name, types.PatchType(types.MergePatchType), b, metav1.PatchOptions{})
 	if err != nil {
 		return nil, err
 	} else {
 		return cm, nil
 	}
-	return cm, nil
 }
 
-func (impl K8sUtil) PatchConfigMapJsonType(namespace string, clusterConfig *ClusterConfig, name string, data interface{}, path string) (*v1.ConfigMap, error) {
+func (impl K8sUtil) PatchConfigMapJsonType(ctx context.Context, namespace string, clusterConfig *ClusterConfig, name string, data interface{}, path string) (*v1.ConfigMap, error) {
 	client, err := impl.GetClient(clusterConfig)
 	if err != nil {
 		return nil, err
@@ -210,13 +382,12 @@ func (impl K8sUtil) PatchConfigMapJsonType(namespace string, clusterConfig *Clus
 		panic(err)
 	}
 
-	cm, err := client.ConfigMaps(namespace).Patch(name, types.PatchType(types.JSONPatchType), b)
+	cm, err := client.ConfigMaps(namespace).Patch(ctx, name, types.PatchType(types.JSONPatchType), b, metav1.PatchOptions{})
 	if err != nil {
 		return nil, err
 	} else {
 		return cm, nil
 	}
-	return cm, nil
 }
 
 type JsonPatchType struct {
@@ -225,36 +396,19 @@ type JsonPatchType struct {
 	Value interface{} `json:"value"`
 }
 
-func (impl K8sUtil) GetSecretFast(namespace string, name string, client *v12.CoreV1Client) (*v1.Secret, error) {
-	cm, err := client.Secrets(namespace).Get(name, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	} else {
-		return cm, nil
-	}
-}
-
-func (impl K8sUtil) CreateSecretFast(namespace string, username string, password string, client *v12.CoreV1Client) (*v1.Secret, error) {
-	secret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: "devtron-secret-test",
-		},
-		Data: map[string][]byte{
-		},
-	}
-	secret, err := client.Secrets(namespace).Create(secret)
-	if err != nil {
-		return nil, err
-	} else {
-		return secret, nil
-	}
+// GetSecretFast reads from the cluster's informer-backed Secret cache,
+// falling through to a live GET on a cache miss.
+func (impl K8sUtil) GetSecretFast(ctx context.Context, namespace string, name string, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	return impl.resourceCache.GetSecret(ctx, clusterConfig, namespace, name)
 }
 
-func (impl K8sUtil) UpdateSecretFast(namespace string, cm *v1.Secret, client *v12.CoreV1Client) (*v1.Secret, error) {
-	cm, err := client.Secrets(namespace).Update(cm)
-	if err != nil {
-		return nil, err
-	} else {
-		return cm, nil
-	}
+// UpdateSecretFast re-fetches the Secret and retries on resource-version
+// conflicts instead of doing a blind Update against a possibly-stale copy.
+func (impl K8sUtil) UpdateSecretFast(ctx context.Context, namespace string, secret *v1.Secret, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	return impl.resourceCache.UpdateSecretWithRetry(ctx, clusterConfig, namespace, secret.Name, func(existing *v1.Secret) {
+		existing.Data = secret.Data
+		existing.StringData = secret.StringData
+		existing.Labels = secret.Labels
+		existing.Annotations = secret.Annotations
+	})
 }
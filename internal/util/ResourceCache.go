@@ -0,0 +1,354 @@
+/*
+ * Copyright (c) 2020 Devtron Labs
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"go.uber.org/zap"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// defaultMaxCachedClusters bounds how many clusters' informers a
+// ResourceCache keeps warm at once; clusters Devtron hasn't touched
+// recently get their informers stopped to free the connection.
+const defaultMaxCachedClusters = 50
+
+// EventType is the kind of change an Event reports.
+type EventType string
+
+const (
+	EventAdded    EventType = "ADDED"
+	EventModified EventType = "MODIFIED"
+	EventDeleted  EventType = "DELETED"
+)
+
+// Event is a single change to a watched ConfigMap or Secret.
+type Event struct {
+	Type   EventType
+	Object interface{}
+}
+
+// ResourceCache maintains informer-backed local stores for ConfigMaps and
+// Secrets, one SharedInformerFactory per cluster, so the CD hot path reads
+// from memory instead of doing a synchronous GET per call. Clusters are
+// kept in a bounded LRU so long-running processes don't accumulate
+// informers for clusters that have stopped being used.
+type ResourceCache struct {
+	logger      *zap.SugaredLogger
+	k8sUtil     *K8sUtil
+	namespaces  []string
+	maxClusters int
+
+	mu       sync.Mutex
+	lru      *list.List
+	elements map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	cluster *clusterResourceCache
+}
+
+// clusterResourceCache is the informer machinery for one cluster: shared
+// ConfigMap/Secret informers plus the set of callers watching individual
+// objects for drift.
+type clusterResourceCache struct {
+	factory        informers.SharedInformerFactory
+	cmInformer     cache.SharedIndexInformer
+	secretInformer cache.SharedIndexInformer
+	stopCh         chan struct{}
+
+	watchersMu sync.Mutex
+	watchers   map[string][]chan Event
+}
+
+// NewResourceCache builds a ResourceCache. When namespaces holds exactly
+// one namespace, only that namespace is watched per cluster; nil/empty, or
+// two or more namespaces, watches every namespace. maxClusters <= 0 uses
+// defaultMaxCachedClusters.
+func NewResourceCache(logger *zap.SugaredLogger, k8sUtil *K8sUtil, namespaces []string, maxClusters int) *ResourceCache {
+	if maxClusters <= 0 {
+		maxClusters = defaultMaxCachedClusters
+	}
+	return &ResourceCache{
+		logger:      logger,
+		k8sUtil:     k8sUtil,
+		namespaces:  namespaces,
+		maxClusters: maxClusters,
+		lru:         list.New(),
+		elements:    make(map[string]*list.Element),
+	}
+}
+
+func (rc *ResourceCache) getCluster(clusterConfig *ClusterConfig) (*clusterResourceCache, error) {
+	key := clusterConfigKey(clusterConfig)
+
+	rc.mu.Lock()
+	if el, ok := rc.elements[key]; ok {
+		rc.lru.MoveToFront(el)
+		rc.mu.Unlock()
+		return el.Value.(*lruEntry).cluster, nil
+	}
+	rc.mu.Unlock()
+
+	cc, err := rc.buildCluster(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.elements[key]; ok {
+		// lost a race building this cluster's informers; keep the winner.
+		rc.lru.MoveToFront(el)
+		close(cc.stopCh)
+		return el.Value.(*lruEntry).cluster, nil
+	}
+	el := rc.lru.PushFront(&lruEntry{key: key, cluster: cc})
+	rc.elements[key] = el
+	rc.evictLocked()
+	return cc, nil
+}
+
+// evictLocked stops the informers for the least-recently-used cluster(s)
+// once the cache has grown past maxClusters. Caller must hold rc.mu.
+func (rc *ResourceCache) evictLocked() {
+	for rc.lru.Len() > rc.maxClusters {
+		oldest := rc.lru.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(*lruEntry)
+		rc.lru.Remove(oldest)
+		delete(rc.elements, entry.key)
+		entry.cluster.closeAllWatchers()
+		close(entry.cluster.stopCh)
+	}
+}
+
+// closeAllWatchers closes every subscriber channel across every key and
+// clears the map, so a Watch caller blocked reading from its channel
+// observes closure instead of hanging forever once this cluster's
+// informers are stopped.
+func (cc *clusterResourceCache) closeAllWatchers() {
+	cc.watchersMu.Lock()
+	defer cc.watchersMu.Unlock()
+	for key, subs := range cc.watchers {
+		for _, ch := range subs {
+			close(ch)
+		}
+		delete(cc.watchers, key)
+	}
+}
+
+func (rc *ResourceCache) buildCluster(clusterConfig *ClusterConfig) (*clusterResourceCache, error) {
+	entry, err := rc.k8sUtil.clientFactory.get(clusterConfig, func() (*rest.Config, error) {
+		return rc.k8sUtil.BuildRestConfig(clusterConfig)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var factory informers.SharedInformerFactory
+	if len(rc.namespaces) == 1 {
+		factory = informers.NewSharedInformerFactoryWithOptions(entry.clientset, 0, informers.WithNamespace(rc.namespaces[0]))
+	} else {
+		// Either unrestricted, or more than one namespace of interest: in
+		// the latter case we watch every namespace and let callers filter
+		// by namespace/name on read, trading a little memory for not
+		// having to juggle N factories per cluster.
+		factory = informers.NewSharedInformerFactory(entry.clientset, 0)
+	}
+
+	cc := &clusterResourceCache{
+		factory:        factory,
+		cmInformer:     factory.Core().V1().ConfigMaps().Informer(),
+		secretInformer: factory.Core().V1().Secrets().Informer(),
+		stopCh:         make(chan struct{}),
+		watchers:       make(map[string][]chan Event),
+	}
+
+	cc.cmInformer.AddEventHandler(cc.handlerFor(EventAdded, EventModified, EventDeleted))
+	cc.secretInformer.AddEventHandler(cc.handlerFor(EventAdded, EventModified, EventDeleted))
+
+	factory.Start(cc.stopCh)
+	factory.WaitForCacheSync(cc.stopCh)
+	return cc, nil
+}
+
+func (cc *clusterResourceCache) handlerFor(added, modified, deleted EventType) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { cc.dispatch(added, obj) },
+		UpdateFunc: func(_, obj interface{}) { cc.dispatch(modified, obj) },
+		DeleteFunc: func(obj interface{}) { cc.dispatch(deleted, obj) },
+	}
+}
+
+func (cc *clusterResourceCache) dispatch(eventType EventType, obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return
+	}
+	cc.watchersMu.Lock()
+	defer cc.watchersMu.Unlock()
+	for _, ch := range cc.watchers[key] {
+		select {
+		case ch <- Event{Type: eventType, Object: obj}:
+		default:
+			// slow consumer; drop rather than block the informer's goroutine.
+		}
+	}
+}
+
+// Watch streams Added/Modified/Deleted events for a single ConfigMap or
+// Secret. The returned cancel func must be called once the caller is done,
+// to release the subscription. ctx offers a second way out: if it's done
+// before cancel is called, the subscription is released the same way; if
+// the cluster is evicted or the cache is shut down, evictLocked/Shutdown
+// close every subscriber channel, so a caller blocked reading from the
+// returned channel observes closure instead of leaking forever.
+func (rc *ResourceCache) Watch(ctx context.Context, clusterConfig *ClusterConfig, namespace string, name string) (<-chan Event, func(), error) {
+	cc, err := rc.getCluster(clusterConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	key := fmt.Sprintf("%s/%s", namespace, name)
+	ch := make(chan Event, 10)
+
+	cc.watchersMu.Lock()
+	cc.watchers[key] = append(cc.watchers[key], ch)
+	cc.watchersMu.Unlock()
+
+	cancel := func() {
+		cc.watchersMu.Lock()
+		defer cc.watchersMu.Unlock()
+		subs := cc.watchers[key]
+		for i, c := range subs {
+			if c == ch {
+				cc.watchers[key] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+	}
+	go func() {
+		<-ctx.Done()
+		cancel()
+	}()
+	return ch, cancel, nil
+}
+
+// GetConfigMap reads from the informer cache, falling through to a live
+// GET on a cache miss. The GET's result is not written to the cache; the
+// informer's own watch adds the object once it sees it.
+func (rc *ResourceCache) GetConfigMap(ctx context.Context, clusterConfig *ClusterConfig, namespace string, name string) (*v1.ConfigMap, error) {
+	cc, err := rc.getCluster(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	if obj, exists, err := cc.cmInformer.GetStore().GetByKey(namespace + "/" + name); err == nil && exists {
+		return obj.(*v1.ConfigMap).DeepCopy(), nil
+	}
+	client, err := rc.k8sUtil.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// GetSecret is GetConfigMap's counterpart for Secrets.
+func (rc *ResourceCache) GetSecret(ctx context.Context, clusterConfig *ClusterConfig, namespace string, name string) (*v1.Secret, error) {
+	cc, err := rc.getCluster(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	if obj, exists, err := cc.secretInformer.GetStore().GetByKey(namespace + "/" + name); err == nil && exists {
+		return obj.(*v1.Secret).DeepCopy(), nil
+	}
+	client, err := rc.k8sUtil.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// UpdateConfigMapWithRetry re-fetches the ConfigMap, applies mutate, and
+// updates, retrying on resource-version conflicts instead of doing a
+// blind Update against a possibly-stale object.
+func (rc *ResourceCache) UpdateConfigMapWithRetry(ctx context.Context, clusterConfig *ClusterConfig, namespace string, name string, mutate func(*v1.ConfigMap)) (*v1.ConfigMap, error) {
+	client, err := rc.k8sUtil.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	var result *v1.ConfigMap
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, err := client.ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mutate(cm)
+		result, err = client.ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+	return result, err
+}
+
+// UpdateSecretWithRetry is UpdateConfigMapWithRetry's counterpart for
+// Secrets.
+func (rc *ResourceCache) UpdateSecretWithRetry(ctx context.Context, clusterConfig *ClusterConfig, namespace string, name string, mutate func(*v1.Secret)) (*v1.Secret, error) {
+	client, err := rc.k8sUtil.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	var result *v1.Secret
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secret, err := client.Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		mutate(secret)
+		result, err = client.Secrets(namespace).Update(ctx, secret, metav1.UpdateOptions{})
+		return err
+	})
+	return result, err
+}
+
+// Shutdown stops every cluster's informers and closes the shared
+// transports backing them. Meant to run once, at process shutdown.
+func (rc *ResourceCache) Shutdown() {
+	rc.mu.Lock()
+	for _, el := range rc.elements {
+		cluster := el.Value.(*lruEntry).cluster
+		cluster.closeAllWatchers()
+		close(cluster.stopCh)
+	}
+	rc.lru = list.New()
+	rc.elements = make(map[string]*list.Element)
+	rc.mu.Unlock()
+
+	rc.k8sUtil.clientFactory.Close()
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2020 Devtron Labs
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package util
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// sealedSecretGVR is SealedSecrets' CRD, as shipped by Bitnami's
+// sealed-secrets controller.
+var sealedSecretGVR = schema.GroupVersionResource{Group: "bitnami.com", Version: "v1alpha1", Resource: "sealedsecrets"}
+
+// CreateDockerRegistrySecret builds and creates a
+// kubernetes.io/dockerconfigjson Secret, the same shape
+// `kubectl create secret docker-registry` produces.
+func (impl K8sUtil) CreateDockerRegistrySecret(ctx context.Context, namespace string, name string, server string, user string, pass string, email string, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	dockerCfg := dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{
+			server: {
+				Username: user,
+				Password: pass,
+				Email:    email,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(user + ":" + pass)),
+			},
+		},
+	}
+	raw, err := json.Marshal(dockerCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshalling docker config: %w", err)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: raw,
+		},
+	}
+	return impl.createSecret(ctx, namespace, secret, clusterConfig)
+}
+
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+// CreateTLSSecret builds and creates a kubernetes.io/tls Secret from a PEM
+// encoded certificate and private key, the same shape
+// `kubectl create secret tls` produces.
+func (impl K8sUtil) CreateTLSSecret(ctx context.Context, namespace string, name string, certPEM []byte, keyPEM []byte, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       v1.SecretTypeTLS,
+		Data: map[string][]byte{
+			v1.TLSCertKey:       certPEM,
+			v1.TLSPrivateKeyKey: keyPEM,
+		},
+	}
+	return impl.createSecret(ctx, namespace, secret, clusterConfig)
+}
+
+// CreateOpaqueSecret builds and creates a plain Opaque Secret from
+// already-encoded data, the same shape `kubectl create secret generic`
+// produces.
+func (impl K8sUtil) CreateOpaqueSecret(ctx context.Context, namespace string, name string, data map[string][]byte, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       v1.SecretTypeOpaque,
+		Data:       data,
+	}
+	return impl.createSecret(ctx, namespace, secret, clusterConfig)
+}
+
+func (impl K8sUtil) createSecret(ctx context.Context, namespace string, secret *v1.Secret, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	client, err := impl.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	return client.Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+}
+
+// UpsertSecret creates secret if it doesn't exist yet, otherwise merges its
+// Data/StringData into the existing Secret and updates it, so repeated
+// calls for the same name accumulate keys instead of clobbering the
+// Secret outright.
+func (impl K8sUtil) UpsertSecret(ctx context.Context, namespace string, secret *v1.Secret, clusterConfig *ClusterConfig) (*v1.Secret, error) {
+	client, err := impl.GetClient(clusterConfig)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := client.Secrets(namespace).Get(ctx, secret.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return client.Secrets(namespace).Create(ctx, secret, metav1.CreateOptions{})
+	} else if err != nil {
+		return nil, err
+	}
+
+	if existing.Data == nil {
+		existing.Data = map[string][]byte{}
+	}
+	for k, v := range secret.Data {
+		existing.Data[k] = v
+	}
+	if existing.StringData == nil {
+		existing.StringData = map[string]string{}
+	}
+	for k, v := range secret.StringData {
+		existing.StringData[k] = v
+	}
+	return client.Secrets(namespace).Update(ctx, existing, metav1.UpdateOptions{})
+}
+
+// SealedSecretSealer seals a plaintext Secret against a cluster's
+// sealed-secrets public cert, producing the bitnami.com/v1alpha1
+// SealedSecret that should be committed to git in the Secret's place.
+type SealedSecretSealer interface {
+	Seal(cert *x509.Certificate, secret *v1.Secret) (*unstructured.Unstructured, error)
+}
+
+// CreateSealedSecret seals secret via sealer and creates the resulting
+// SealedSecret object, so pipeline artifacts committed to git carry only
+// the encrypted form.
+func (impl K8sUtil) CreateSealedSecret(ctx context.Context, namespace string, secret *v1.Secret, cert *x509.Certificate, sealer SealedSecretSealer, clusterConfig *ClusterConfig) (*unstructured.Unstructured, error) {
+	sealed, err := sealer.Seal(cert, secret)
+	if err != nil {
+		return nil, fmt.Errorf("failed sealing secret %s: %w", secret.Name, err)
+	}
+	client, err := impl.GetDynamicClient(clusterConfig, sealedSecretGVR, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return client.Create(ctx, sealed)
+}